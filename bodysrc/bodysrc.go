@@ -0,0 +1,159 @@
+// Package bodysrc supplies request bodies for the load-test tool. A
+// Source produces the bytes for a given request count, which lets the
+// tool cycle through canned payloads instead of always sending the same
+// synthetic JSON body.
+package bodysrc
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Source produces the request body for a given request count. Count is
+// 1-indexed and matches the request's position within the run.
+type Source interface {
+	Body(count int) ([]byte, error)
+}
+
+// New builds a Source from the --body-file and --body-template flags.
+// With neither flag set it returns the synthetic default body. With only
+// bodyFile set, a ".jsonl" file is cycled round-robin one record per
+// request and anything else is sent as-is on every request. With both
+// set, bodyFile is read as CSV and each row fills bodyTemplate.
+func New(bodyFile, bodyTemplate string) (Source, error) {
+	switch {
+	case bodyTemplate != "":
+		if bodyFile == "" {
+			return nil, fmt.Errorf("bodysrc: --body-template requires --body-file to supply CSV rows")
+		}
+		return NewCSVTemplate(bodyFile, bodyTemplate)
+	case bodyFile == "":
+		return Synthetic{}, nil
+	case strings.HasSuffix(bodyFile, ".jsonl"):
+		return NewJSONL(bodyFile)
+	default:
+		return NewStaticFile(bodyFile)
+	}
+}
+
+// Synthetic is the tool's original default body: a small JSON object
+// identifying the request by number.
+type Synthetic struct{}
+
+func (Synthetic) Body(count int) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"name":          fmt.Sprintf("request #%d", count),
+		"date":          time.Now().String(),
+		"requests_sent": count,
+	})
+}
+
+// StaticFile returns the same file contents for every request.
+type StaticFile struct {
+	body []byte
+}
+
+func NewStaticFile(path string) (*StaticFile, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticFile{body: body}, nil
+}
+
+func (s *StaticFile) Body(count int) ([]byte, error) {
+	return s.body, nil
+}
+
+// JSONL cycles through the records of a newline-delimited JSON file,
+// one record per request, wrapping back to the start once exhausted.
+type JSONL struct {
+	records [][]byte
+}
+
+func NewJSONL(path string) (*JSONL, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records [][]byte
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		records = append(records, line)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("bodysrc: %s contains no JSONL records", path)
+	}
+	return &JSONL{records: records}, nil
+}
+
+func (j *JSONL) Body(count int) ([]byte, error) {
+	return j.records[(count-1)%len(j.records)], nil
+}
+
+// CSVTemplate renders a text/template once per CSV row, cycling through
+// rows round-robin. The header row names the template fields.
+type CSVTemplate struct {
+	tmpl *template.Template
+	rows []map[string]string
+}
+
+func NewCSVTemplate(csvPath, tmplPath string) (*CSVTemplate, error) {
+	tmplBytes, err := ioutil.ReadFile(tmplPath)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(tmplPath)).Parse(string(tmplBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("bodysrc: %s must have a header row plus at least one data row", csvPath)
+	}
+
+	header := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, col := range header {
+			if i < len(record) {
+				row[col] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return &CSVTemplate{tmpl: tmpl, rows: rows}, nil
+}
+
+func (c *CSVTemplate) Body(count int) ([]byte, error) {
+	row := c.rows[(count-1)%len(c.rows)]
+	var buf bytes.Buffer
+	if err := c.tmpl.Execute(&buf, row); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+)
+
+// dumpMode controls the --dump flag. It behaves like a bool flag (bare
+// --dump enables it) but also accepts "errors" or "all" as an explicit
+// value.
+type dumpMode string
+
+const (
+	dumpOff    dumpMode = ""
+	dumpErrors dumpMode = "errors"
+	dumpAll    dumpMode = "all"
+)
+
+func (d *dumpMode) String() string { return string(*d) }
+
+func (d *dumpMode) Set(v string) error {
+	switch v {
+	case "", "false":
+		*d = dumpOff
+	case "true", "errors":
+		*d = dumpErrors
+	case "all":
+		*d = dumpAll
+	default:
+		return fmt.Errorf("invalid --dump value %q, want \"errors\" or \"all\"", v)
+	}
+	return nil
+}
+
+func (d *dumpMode) IsBoolFlag() bool { return true }
+
+// dumper writes wire-level request/response traces to a per-run log
+// directory, one file per request/attempt/direction. Body dumping for
+// responses is gated on error status codes unless the mode is "all".
+type dumper struct {
+	mode dumpMode
+	dir  string
+}
+
+func newDumper(mode dumpMode) (*dumper, error) {
+	if mode == dumpOff {
+		return &dumper{mode: dumpOff}, nil
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("loadtester-dump-%d", os.Getpid()))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	log.Println("dump mode enabled, writing wire traces to", dir)
+	return &dumper{mode: mode, dir: dir}, nil
+}
+
+// request writes the full outgoing request for index/attempt.
+func (d *dumper) request(index, attempt int, req *http.Request) {
+	if d.mode == dumpOff {
+		return
+	}
+	raw, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		log.Printf("dump: request #%d >> %v", index, err)
+		return
+	}
+	d.write(index, attempt, "request", raw)
+}
+
+// response writes the response for index/attempt. The body is only
+// included when the mode is "all" or the response/error indicates
+// failure.
+func (d *dumper) response(index, attempt int, resp *http.Response, reqErr error) {
+	if d.mode == dumpOff || resp == nil {
+		return
+	}
+	isError := reqErr != nil || resp.StatusCode >= 400
+	raw, err := httputil.DumpResponse(resp, d.mode == dumpAll || isError)
+	if err != nil {
+		log.Printf("dump: response #%d >> %v", index, err)
+		return
+	}
+	d.write(index, attempt, "response", raw)
+}
+
+func (d *dumper) write(index, attempt int, kind string, raw []byte) {
+	name := filepath.Join(d.dir, fmt.Sprintf("%05d-attempt%d-%s.log", index, attempt, kind))
+	if err := os.WriteFile(name, raw, 0o644); err != nil {
+		log.Printf("dump: %s #%d >> %v", kind, index, err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LatencySummary is the JSON-friendly snapshot of a LatencyHistogram
+// that ends up in the final Report.
+type LatencySummary struct {
+	MinMS  float64
+	MeanMS float64
+	P50MS  float64
+	P90MS  float64
+	P99MS  float64
+	MaxMS  float64
+}
+
+// LatencyHistogram is a log-bucketed histogram: each bucket spans a
+// power-of-two range of microseconds, so memory use is O(log(max
+// latency)) rather than O(request count) like keeping every sample
+// would be.
+type LatencyHistogram struct {
+	mu      sync.Mutex
+	buckets map[int]int64
+	count   int64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{buckets: make(map[int]int64)}
+}
+
+func (h *LatencyHistogram) Record(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.sum += d
+	h.count++
+	h.buckets[latencyBucket(d)]++
+}
+
+func latencyBucket(d time.Duration) int {
+	us := d.Microseconds()
+	if us < 1 {
+		return 0
+	}
+	return int(math.Log2(float64(us)))
+}
+
+func latencyBucketMidpoint(bucket int) time.Duration {
+	lo := math.Pow(2, float64(bucket))
+	hi := math.Pow(2, float64(bucket+1))
+	midUs := (lo + hi) / 2
+	return time.Duration(midUs * float64(time.Microsecond))
+}
+
+// Percentile returns the approximate latency at the given percentile
+// (0-100), reconstructed from the bucket the request actually fell in.
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(p / 100 * float64(h.count)))
+	if target < 1 {
+		target = 1
+	}
+
+	keys := make([]int, 0, len(h.buckets))
+	for k := range h.buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	var cumulative int64
+	for _, k := range keys {
+		cumulative += h.buckets[k]
+		if cumulative >= target {
+			return latencyBucketMidpoint(k)
+		}
+	}
+	return h.max
+}
+
+func (h *LatencyHistogram) Mean() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+func (h *LatencyHistogram) Min() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.min
+}
+
+func (h *LatencyHistogram) Max() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.max
+}
+
+func (h *LatencyHistogram) Summary() LatencySummary {
+	return LatencySummary{
+		MinMS:  h.Min().Seconds() * 1000,
+		MeanMS: h.Mean().Seconds() * 1000,
+		P50MS:  h.Percentile(50).Seconds() * 1000,
+		P90MS:  h.Percentile(90).Seconds() * 1000,
+		P99MS:  h.Percentile(99).Seconds() * 1000,
+		MaxMS:  h.Max().Seconds() * 1000,
+	}
+}
+
+// LatencyRecorder feeds a LatencyHistogram and, when --latency-csv is
+// set, also appends every raw sample to a CSV file for offline analysis.
+type LatencyRecorder struct {
+	hist  *LatencyHistogram
+	csvMu sync.Mutex
+	csvW  *csv.Writer
+	csvF  *os.File
+}
+
+func NewLatencyRecorder(csvPath string) (*LatencyRecorder, error) {
+	lr := &LatencyRecorder{hist: NewLatencyHistogram()}
+	if csvPath == "" {
+		return lr, nil
+	}
+	f, err := os.Create(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"index", "status_code", "latency_ms"}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.Flush()
+	lr.csvF = f
+	lr.csvW = w
+	return lr, nil
+}
+
+func (lr *LatencyRecorder) Record(index, statusCode int, d time.Duration) {
+	lr.hist.Record(d)
+	if lr.csvW == nil {
+		return
+	}
+	lr.csvMu.Lock()
+	defer lr.csvMu.Unlock()
+	lr.csvW.Write([]string{
+		strconv.Itoa(index),
+		strconv.Itoa(statusCode),
+		strconv.FormatFloat(d.Seconds()*1000, 'f', 3, 64),
+	})
+	lr.csvW.Flush()
+}
+
+func (lr *LatencyRecorder) Summary() LatencySummary {
+	return lr.hist.Summary()
+}
+
+func (lr *LatencyRecorder) Close() error {
+	if lr.csvF == nil {
+		return nil
+	}
+	lr.csvW.Flush()
+	return lr.csvF.Close()
+}
+
+// statusCounter tallies responses by HTTP status code (0 for requests
+// that never got a response) across concurrent workers.
+type statusCounter struct {
+	mu     sync.Mutex
+	counts map[int]int
+}
+
+func newStatusCounter() *statusCounter {
+	return &statusCounter{counts: make(map[int]int)}
+}
+
+func (s *statusCounter) add(code int) {
+	s.mu.Lock()
+	s.counts[code]++
+	s.mu.Unlock()
+}
+
+func (s *statusCounter) snapshot() map[int]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[int]int, len(s.counts))
+	for k, v := range s.counts {
+		out[k] = v
+	}
+	return out
+}
+
+// runStats bundles the observability state shared across a run's
+// workers, analogous to the dumper and TokenBucket.
+type runStats struct {
+	latency *LatencyRecorder
+	status  *statusCounter
+}
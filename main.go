@@ -2,16 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"loadtester/bodysrc"
 )
 
 type Request struct {
@@ -21,9 +28,117 @@ type Request struct {
 }
 
 type Report struct {
-	TotalRequests int
-	TotalSuccess  int
-	TotalFail     int
+	mu sync.Mutex
+
+	TotalRequests  int
+	TotalSuccess   int
+	TotalFail      int
+	TotalRetries   int
+	RetriedSuccess int
+	RetriedFail    int
+	Latency        LatencySummary
+	StatusCodes    map[int]int
+}
+
+// addOutcome records a request's terminal outcome, including whether it
+// only succeeded/failed after one or more retries. It is called
+// concurrently by every worker, so it locks Report's own mutex - the
+// same protection already applied to statusCounter and LatencyHistogram.
+func (r *Report) addOutcome(success, retried bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.TotalRequests++
+	if success {
+		r.TotalSuccess++
+		if retried {
+			r.RetriedSuccess++
+		}
+	} else {
+		r.TotalFail++
+		if retried {
+			r.RetriedFail++
+		}
+	}
+}
+
+// addRetry records one retry attempt. Called concurrently by every
+// worker, so it shares Report's mutex with addOutcome.
+func (r *Report) addRetry() {
+	r.mu.Lock()
+	r.TotalRetries++
+	r.mu.Unlock()
+}
+
+// Config bundles every flag needed to drive a run. It grew out of
+// getFlags' return tuple once the body/header/query options made that
+// tuple unwieldy.
+type Config struct {
+	URL             string
+	Key             string
+	Method          string
+	Headers         stringList
+	Query           stringList
+	BodyFile        string
+	BodyTemplate    string
+	RQS             int
+	Duration        int
+	Workers         int
+	Burst           int
+	Verbose         bool
+	Retry           RetryConfig
+	Dump            dumpMode
+	LatencyCSV      string
+	ShutdownTimeout time.Duration
+}
+
+// stringList accumulates repeatable flags such as --header and --query.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// buildURL parses rawURL and appends any --query key=value pairs.
+func buildURL(rawURL string, query stringList) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	for _, kv := range query {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --query %q, want key=value", kv)
+		}
+		q.Add(parts[0], parts[1])
+	}
+	u.RawQuery = q.Encode()
+	return u, nil
+}
+
+// buildHeaders parses --header "Key: Value" entries and fills in the
+// tool's defaults for anything the user didn't override.
+func buildHeaders(key string, headerList stringList) (http.Header, error) {
+	headers := http.Header{}
+	for _, h := range headerList {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --header %q, want \"Key: Value\"", h)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if headers.Get("Content-Type") == "" {
+		headers.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	if headers.Get("X-Api-Key") == "" && key != "" {
+		headers.Set("X-Api-Key", key)
+	}
+	return headers, nil
 }
 
 func exitGracefully(err error) {
@@ -37,42 +152,75 @@ func check(err error) {
 	}
 }
 
-func doRequest(wg *sync.WaitGroup, resultC, errorC chan Request, count int,
-	reqUrl, key string, verbose bool, report *Report) {
+func doRequest(ctx context.Context, client *http.Client, wg *sync.WaitGroup, resultC, errorC chan Request, count int,
+	reqURL *url.URL, method string, headers http.Header, source bodysrc.Source,
+	verbose bool, report *Report, retryCfg RetryConfig, dump *dumper, stats *runStats) {
 	defer wg.Done()
-	reqURL, _ := url.Parse(reqUrl)
-	bodyBytes, _ := json.Marshal(map[string]interface{}{
-		"name":          fmt.Sprintf("request #%d", count),
-		"date":          time.Now().String(),
-		"requests_sent": count,
-	})
-	reqBody := bytes.NewReader(bodyBytes)
-	body := ioutil.NopCloser(reqBody)
-	req := &http.Request{
-		Method: "POST",
-		URL:    reqURL,
-		Header: map[string][]string{
-			"Content-Type": {"application/json; charset=UTF-8"},
-			"X-Api-Key":    {key},
-		},
-		Body: body,
-	}
-	resp, err := http.DefaultClient.Do(req)
-	report.TotalRequests += 1
+	bodyBytes, err := source.Body(count)
+	if err != nil {
+		report.addOutcome(false, false)
+		errorC <- Request{Index: count, Err: err}
+		return
+	}
+
+	var resp *http.Response
+	var elapsed time.Duration
+	attempt := 0
+	for {
+		reqBody := bytes.NewReader(bodyBytes)
+		body := ioutil.NopCloser(reqBody)
+		req := (&http.Request{
+			Method: method,
+			URL:    reqURL,
+			Header: headers,
+			Body:   body,
+		}).WithContext(ctx)
+		dump.request(count, attempt, req)
+		start := time.Now()
+		resp, err = client.Do(req)
+		elapsed = time.Since(start)
+		dump.response(count, attempt, resp, err)
+
+		if attempt >= retryCfg.MaxRetries || !shouldRetry(resp, err) {
+			break
+		}
+
+		wait := retryAfter(resp)
+		if wait <= 0 {
+			wait = backoffWithJitter(attempt, retryCfg.Base, retryCfg.Cap)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		attempt++
+		report.addRetry()
+		time.Sleep(wait)
+	}
+
+	// stats reflect the request's final attempt only, so retries do not
+	// add extra StatusCodes or Latency samples. A request whose body could
+	// not be built returns above and is counted in TotalRequests only.
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	stats.latency.Record(count, statusCode, elapsed)
+	stats.status.add(statusCode)
+
 	// properly handle http codes here
 	// for instance, to retry a request or to collect the http status for error mapping
 	if resp != nil {
 		// valid success http status codes: 200, 201, 202, 204
 		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted &&
 			resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
-			report.TotalFail += 1
+			report.addOutcome(false, attempt > 0)
 			errorC <- Request{
 				Index:    count,
 				Err:      err,
 				Response: resp,
 			}
 		} else {
-			report.TotalSuccess += 1
+			report.addOutcome(true, attempt > 0)
 			resultC <- Request{
 				Index:    count,
 				Response: resp,
@@ -80,7 +228,7 @@ func doRequest(wg *sync.WaitGroup, resultC, errorC chan Request, count int,
 		}
 	}
 	if err != nil {
-		report.TotalFail += 1
+		report.addOutcome(false, attempt > 0)
 		errorC <- Request{
 			Index: count,
 			Err:   err,
@@ -88,83 +236,164 @@ func doRequest(wg *sync.WaitGroup, resultC, errorC chan Request, count int,
 	}
 }
 
-func processResults(bulk int, resultC chan Request, verbose bool) {
+// processResults blocks on resultC until executeRequests closes it,
+// guaranteeing every response body is fully drained and closed so the
+// underlying connection can be reused for keep-alive.
+func processResults(bulk int, resultC <-chan Request, verbose bool, done chan<- struct{}) {
 	count := 0
-	for {
-		select {
-		case res := <-resultC:
-			count++
-			if count == 1 {
-				log.Println("buffer #", bulk)
-			}
-			log.Printf("request #%d >> http status response %d", res.Index, res.Response.StatusCode)
-			if verbose {
-				respBody, err := ioutil.ReadAll(res.Response.Body)
-				check(err)
-				prettyResp, err := prettyPrint(respBody)
-				check(err)
-				log.Printf("request #%d >> response: %s", res.Index, string(prettyResp))
+	for res := range resultC {
+		count++
+		if count == 1 {
+			log.Println("buffer #", bulk)
+		}
+		log.Printf("request #%d >> http status response %d", res.Index, res.Response.StatusCode)
+		respBody, err := ioutil.ReadAll(res.Response.Body)
+		res.Response.Body.Close()
+		if err != nil {
+			log.Printf("request #%d >> error reading response body: %v", res.Index, err)
+			continue
+		}
+		if verbose {
+			prettyResp, err := prettyPrint(respBody)
+			if err != nil {
+				log.Printf("request #%d >> error formatting response: %v", res.Index, err)
+				continue
 			}
-			defer res.Response.Body.Close()
-		default:
+			log.Printf("request #%d >> response: %s", res.Index, string(prettyResp))
 		}
 	}
+	close(done)
 }
 
-func processErrors(bulk int, errorC chan Request, verbose bool) {
+// processErrors blocks on errorC until executeRequests closes it. Error
+// responses are drained and closed the same as successful ones, even
+// when verbose is false.
+func processErrors(bulk int, errorC <-chan Request, verbose bool, done chan<- struct{}) {
 	count := 0
-	for {
-		select {
-		case err := <-errorC:
-			count++
-			if count == 1 {
-				log.Println("buffer #", bulk)
+	for err := range errorC {
+		count++
+		if count == 1 {
+			log.Println("buffer #", bulk)
+		}
+		if err.Err != nil {
+			log.Printf("error on request #%d >> %v", err.Index, err.Err)
+		} else {
+			log.Printf("error on request #%d >> http status code: %d", err.Index, err.Response.StatusCode)
+		}
+		if err.Response != nil {
+			respBody, readErr := ioutil.ReadAll(err.Response.Body)
+			err.Response.Body.Close()
+			if readErr != nil {
+				log.Printf("request #%d >> error reading response body: %v", err.Index, readErr)
+				continue
 			}
-			if err.Err != nil {
-				log.Printf("error on request #%d >> %v", err.Index, err.Err)
-			} else {
-				log.Printf("error on request #%d >> http status code: %d", err.Index, err.Response.StatusCode)
-				if verbose {
-					respBody, newErr := ioutil.ReadAll(err.Response.Body)
-					check(newErr)
-					if len(respBody) > 0 {
-						log.Printf("request #%d >> response: %s", err.Index, string(respBody))
-					}
-				}
+			if verbose && len(respBody) > 0 {
+				log.Printf("request #%d >> response: %s", err.Index, string(respBody))
 			}
-		default:
 		}
 	}
+	close(done)
 }
 
-func executeRequestWithTimer(url, key string, rqs int, verbose bool, report *Report) {
-	count := 0
-	for range time.Tick(time.Second * time.Duration(1)) {
-		count++
-		resultChannel := make(chan Request)
-		errorChannel := make(chan Request)
+// worker reads job indexes off jobs until it is closed, pacing each one
+// against the shared token bucket before issuing it.
+func worker(ctx context.Context, client *http.Client, jobs <-chan int, wg *sync.WaitGroup, resultC, errorC chan Request,
+	reqURL *url.URL, method string, headers http.Header, source bodysrc.Source,
+	verbose bool, report *Report, retryCfg RetryConfig, bucket *TokenBucket, dump *dumper, stats *runStats) {
+	for idx := range jobs {
+		bucket.Take()
+		doRequest(ctx, client, wg, resultC, errorC, idx, reqURL, method, headers, source, verbose, report, retryCfg, dump, stats)
+	}
+}
 
-		var wg sync.WaitGroup
+// executeRequests runs the load test until cfg.Duration elapses or ctx
+// is cancelled (SIGINT/SIGTERM). On cancellation it stops scheduling new
+// requests and waits up to cfg.ShutdownTimeout for in-flight ones to
+// finish before forcibly cancelling them, then prints whatever partial
+// report has accumulated.
+func executeRequests(ctx context.Context, cfg Config) {
+	reqURL, err := buildURL(cfg.URL, cfg.Query)
+	check(err)
+	headers, err := buildHeaders(cfg.Key, cfg.Headers)
+	check(err)
+	source, err := bodysrc.New(cfg.BodyFile, cfg.BodyTemplate)
+	check(err)
+	dump, err := newDumper(cfg.Dump)
+	check(err)
+	latency, err := NewLatencyRecorder(cfg.LatencyCSV)
+	check(err)
+	defer latency.Close()
+	stats := &runStats{latency: latency, status: newStatusCounter()}
 
-		for idx := 1; idx <= rqs; idx++ {
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	client := &http.Client{}
+
+	report := Report{}
+	resultChannel := make(chan Request)
+	errorChannel := make(chan Request)
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	bucket := NewTokenBucket(float64(cfg.RQS), cfg.Burst)
+
+	resultsDone := make(chan struct{})
+	errorsDone := make(chan struct{})
+	go processResults(1, resultChannel, cfg.Verbose, resultsDone)
+	go processErrors(1, errorChannel, cfg.Verbose, errorsDone)
+
+	for w := 0; w < cfg.Workers; w++ {
+		go worker(requestCtx, client, jobs, &wg, resultChannel, errorChannel, reqURL, cfg.Method, headers, source, cfg.Verbose, &report, cfg.Retry, bucket, dump, stats)
+	}
+
+	log.Println("Waiting for all requests to be executed...")
+	deadline := time.After(time.Second * time.Duration(cfg.Duration))
+	count := 0
+produce:
+	for {
+		select {
+		case <-deadline:
+			break produce
+		case <-ctx.Done():
+			log.Println("shutdown requested, no longer scheduling new requests")
+			break produce
+		default:
+			count++
 			wg.Add(1)
-			go doRequest(&wg, resultChannel, errorChannel, idx, url, key, verbose, report)
+			jobs <- count
 		}
+	}
+	close(jobs)
 
-		go processResults(count, resultChannel, verbose)
-		go processErrors(count, errorChannel, verbose)
+	workersDone := make(chan struct{})
+	go func() {
 		wg.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		select {
+		case <-workersDone:
+		case <-time.After(cfg.ShutdownTimeout):
+			log.Println("shutdown timeout elapsed, cancelling in-flight requests")
+			cancelRequests()
+			<-workersDone
+		}
 	}
-}
 
-func executeRequests(url, key string, rqs, duration int, verbose bool) {
-	report := Report{}
-	log.Println("Waiting for all requests to be executed...")
-	go executeRequestWithTimer(url, key, rqs, verbose, &report)
-	time.Sleep(time.Second * time.Duration(duration+1))
+	close(resultChannel)
+	close(errorChannel)
+	<-resultsDone
+	<-errorsDone
+
+	report.Latency = stats.latency.Summary()
+	report.StatusCodes = stats.status.snapshot()
+
 	log.Println("Requests executed successfully.")
 	log.Println("--------------------REPORT--------------------")
-	jsonReport, err := json.Marshal(report)
+	jsonReport, err := json.Marshal(&report)
 	check(err)
 	prettyReport, err := prettyPrint(jsonReport)
 	check(err)
@@ -177,19 +406,46 @@ func prettyPrint(b []byte) ([]byte, error) {
 	return out.Bytes(), err
 }
 
-func getFlags() (urlPtr, keyPtr string, rqsPtr, durationPtr int, verbosePtr bool) {
-	flag.StringVar(&urlPtr, "url", "https://postman-echo.com/post", "the server POST url")
-	flag.StringVar(&keyPtr, "key", "RIqhxTAKNGaSw2waOY2CW3LhLny2EpI27i56VA6N", "the server API key")
-	flag.IntVar(&rqsPtr, "rqs", 10, "requests per seconds")
-	flag.IntVar(&durationPtr, "duration", 1, "duration in seconds")
-	flag.BoolVar(&verbosePtr, "verbose", false, "whether to print out the response of each request or not")
+func getFlags() Config {
+	var cfg Config
+	flag.StringVar(&cfg.URL, "url", "https://postman-echo.com/post", "the server url")
+	flag.StringVar(&cfg.Key, "key", "RIqhxTAKNGaSw2waOY2CW3LhLny2EpI27i56VA6N", "the server API key")
+	flag.StringVar(&cfg.Method, "method", "POST", "the HTTP method to use")
+	flag.Var(&cfg.Headers, "header", "extra request header \"Key: Value\" (repeatable)")
+	flag.Var(&cfg.Query, "query", "extra URL query parameter key=value (repeatable)")
+	flag.StringVar(&cfg.BodyFile, "body-file", "", "path to a request body source: a static file, a .jsonl file cycled round-robin, or (with --body-template) a CSV of template rows")
+	flag.StringVar(&cfg.BodyTemplate, "body-template", "", "text/template file rendered once per --body-file CSV row")
+	flag.IntVar(&cfg.RQS, "rqs", 10, "requests per seconds")
+	flag.IntVar(&cfg.Duration, "duration", 1, "duration in seconds")
+	flag.IntVar(&cfg.Workers, "workers", 10, "number of persistent workers pulling from the job queue")
+	flag.IntVar(&cfg.Burst, "burst", 10, "token bucket burst size")
+	flag.BoolVar(&cfg.Verbose, "verbose", false, "whether to print out the response of each request or not")
+	flag.IntVar(&cfg.Retry.MaxRetries, "max-retries", 0, "max number of retries for transient failures (network errors, 429s, 5xx)")
+	flag.DurationVar(&cfg.Retry.Base, "retry-base", 100*time.Millisecond, "base delay for exponential backoff between retries")
+	flag.DurationVar(&cfg.Retry.Cap, "retry-cap", 5*time.Second, "max delay for exponential backoff between retries")
+	flag.Var(&cfg.Dump, "dump", "write wire-level request/response dumps to a log directory; bare --dump only dumps error bodies, --dump=all also dumps successes")
+	flag.StringVar(&cfg.LatencyCSV, "latency-csv", "", "write a CSV of raw per-request latency samples to this path")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests to finish after a SIGINT/SIGTERM before cancelling them")
 	flag.Parse()
-	fmt.Println("url:", urlPtr)
-	fmt.Println("key:", keyPtr)
-	fmt.Println("rqs:", rqsPtr)
-	fmt.Println("duration:", durationPtr)
-	fmt.Println("verbose:", verbosePtr)
-	return
+	fmt.Println("url:", cfg.URL)
+	fmt.Println("key:", cfg.Key)
+	fmt.Println("method:", cfg.Method)
+	fmt.Println("header:", cfg.Headers)
+	fmt.Println("query:", cfg.Query)
+	fmt.Println("body-file:", cfg.BodyFile)
+	fmt.Println("body-template:", cfg.BodyTemplate)
+	fmt.Println("rqs:", cfg.RQS)
+	fmt.Println("duration:", cfg.Duration)
+	fmt.Println("workers:", cfg.Workers)
+	fmt.Println("burst:", cfg.Burst)
+	fmt.Println("verbose:", cfg.Verbose)
+	fmt.Println("max-retries:", cfg.Retry.MaxRetries)
+	fmt.Println("retry-base:", cfg.Retry.Base)
+	fmt.Println("retry-cap:", cfg.Retry.Cap)
+	fmt.Println("dump:", cfg.Dump)
+	fmt.Println("latency-csv:", cfg.LatencyCSV)
+	fmt.Println("shutdown-timeout:", cfg.ShutdownTimeout)
+	return cfg
 }
 
 func main() {
@@ -198,7 +454,18 @@ func main() {
 		flag.PrintDefaults()
 	}
 
-	url, key, rqs, duration, verbose := getFlags()
+	rand.Seed(time.Now().UnixNano())
+
+	cfg := getFlags()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		log.Println("received interrupt, shutting down gracefully...")
+		cancel()
+	}()
 
-	executeRequests(url, key, rqs, duration, verbose)
+	executeRequests(ctx, cfg)
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket paces work at a steady rate of tokens per second, allowing
+// short bursts up to a configured size. It decouples concurrency (how
+// many workers run at once) from throughput (how many requests per
+// second are issued).
+type TokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	max      float64
+	tokens   float64
+	lastFill time.Time
+}
+
+// NewTokenBucket creates a bucket that refills at rate tokens/second up
+// to a maximum of burst tokens. The bucket starts full.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	max := float64(burst)
+	if max <= 0 {
+		max = 1
+	}
+	return &TokenBucket{
+		rate:     rate,
+		max:      max,
+		tokens:   max,
+		lastFill: time.Now(),
+	}
+}
+
+// Take blocks until a token is available and then consumes it.
+func (tb *TokenBucket) Take() {
+	for !tb.takeIfAvailable() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (tb *TokenBucket) takeIfAvailable() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.lastFill).Seconds() * tb.rate
+	if tb.tokens > tb.max {
+		tb.tokens = tb.max
+	}
+	tb.lastFill = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
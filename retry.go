@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryConfig controls the backoff behavior doRequest applies to
+// transient failures (network errors, 429s, and 5xx responses).
+type RetryConfig struct {
+	MaxRetries int
+	Base       time.Duration
+	Cap        time.Duration
+}
+
+// shouldRetry reports whether a request should be retried given the
+// response and error returned by http.Client.Do.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if resp == nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// backoffWithJitter implements exponential backoff with full jitter: on
+// attempt n it returns a random duration in [0, min(cap, base*2^n)).
+func backoffWithJitter(attempt int, base, cap time.Duration) time.Duration {
+	upper := base << uint(attempt)
+	if upper <= 0 || upper > cap {
+		upper = cap
+	}
+	if upper <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(upper)))
+}
+
+// retryAfter reads the Retry-After header, if present, and returns the
+// duration the server asked us to wait before the next attempt.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}